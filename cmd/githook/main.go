@@ -0,0 +1,216 @@
+// Command githook drains the job queue a post-receive hook enqueues into,
+// and gives operators visibility into it via `githook jobs`.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/erred/githook/internal/ci"
+	"github.com/erred/githook/internal/jobqueue"
+)
+
+func main() {
+	ctx := context.Background()
+	ctx, done := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer done()
+
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: githook {daemon|jobs} ...")
+		os.Exit(1)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "daemon":
+		err = runDaemon(ctx, os.Args[2:])
+	case "jobs":
+		err = runJobs(ctx, os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown subcommand %q", os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "githook", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// runDaemon drains the job queue: claim a ready job, dispatch it, record the
+// result, and retry with exponential backoff on failure.
+func runDaemon(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	dbPath := fs.String("db", "githook.db", "path to the job store")
+	httpAddr := fs.String("http-addr", "", "optional address to serve job status over HTTP, e.g. 127.0.0.1:4123")
+	poll := fs.Duration("poll", time.Second, "how often to poll for ready jobs when the queue is empty")
+	fs.Parse(args)
+
+	lg := slog.New(slog.NewTextHandler(ci.NewRedactingWriter(os.Stderr, ci.DefaultRedactor), &slog.HandlerOptions{}))
+
+	store, err := jobqueue.Open(*dbPath)
+	if err != nil {
+		return fmt.Errorf("open job store: %w", err)
+	}
+	defer store.Close()
+
+	if *httpAddr != "" {
+		srv := &http.Server{Addr: *httpAddr, Handler: jobsHandler(store)}
+		go func() {
+			lg.LogAttrs(ctx, slog.LevelInfo, "serving job status", slog.String("addr", *httpAddr))
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				lg.LogAttrs(ctx, slog.LevelError, "http server", slog.String("error", err.Error()))
+			}
+		}()
+		defer srv.Close()
+	}
+
+	ticker := time.NewTicker(*poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			for {
+				job, err := store.ClaimNext(ctx)
+				if err != nil {
+					lg.LogAttrs(ctx, slog.LevelError, "claim job", slog.String("error", err.Error()))
+					break
+				}
+				if job == nil {
+					break
+				}
+				dispatchJob(ctx, lg, store, job)
+			}
+		}
+	}
+}
+
+func dispatchJob(ctx context.Context, lg *slog.Logger, store *jobqueue.Store, job *jobqueue.Job) {
+	var dj ci.DispatchJob
+	if err := json.Unmarshal(job.Payload, &dj); err != nil {
+		lg.LogAttrs(ctx, slog.LevelError, "decode job payload", slog.String("uuid", job.UUID), slog.String("error", err.Error()))
+		if err := store.Retry(ctx, job.UUID, err, 0); err != nil {
+			lg.LogAttrs(ctx, slog.LevelError, "mark job retry", slog.String("uuid", job.UUID), slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	res := dj.Dispatch(ctx, lg)
+	if res.Err != nil {
+		backoff := backoffFor(job.Attempts + 1)
+		lg.LogAttrs(ctx, slog.LevelWarn, "dispatch failed, will retry", slog.String("uuid", job.UUID), slog.String("backend", job.Backend), slog.String("error", res.Err.Error()), slog.Duration("backoff", backoff))
+		if err := store.Retry(ctx, job.UUID, res.Err, backoff); err != nil {
+			lg.LogAttrs(ctx, slog.LevelError, "mark job retry", slog.String("uuid", job.UUID), slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	lg.LogAttrs(ctx, slog.LevelInfo, "dispatch succeeded", slog.String("uuid", job.UUID), slog.String("backend", job.Backend))
+	if err := store.Complete(ctx, job.UUID, res.String()); err != nil {
+		lg.LogAttrs(ctx, slog.LevelError, "mark job complete", slog.String("uuid", job.UUID), slog.String("error", err.Error()))
+	}
+}
+
+// backoffFor is capped exponential backoff: 1s, 2s, 4s, ... up to 5 minutes.
+func backoffFor(attempts int) time.Duration {
+	d := time.Second << uint(attempts)
+	if d > 5*time.Minute || d <= 0 {
+		d = 5 * time.Minute
+	}
+	return d
+}
+
+// runJobs implements `githook jobs {list,logs,status <uuid>}`.
+func runJobs(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+	dbPath := fs.String("db", "githook.db", "path to the job store")
+	if len(args) == 0 {
+		return fmt.Errorf("usage: githook jobs {list,logs,status} [-db path] [<uuid>]")
+	}
+	sub, rest := args[0], args[1:]
+	fs.Parse(rest)
+
+	store, err := jobqueue.Open(*dbPath)
+	if err != nil {
+		return fmt.Errorf("open job store: %w", err)
+	}
+	defer store.Close()
+
+	switch sub {
+	case "list":
+		jobs, err := store.List(ctx)
+		if err != nil {
+			return err
+		}
+		for _, j := range jobs {
+			fmt.Printf("%s\t%s\t%s\tattempts=%d\n", j.UUID, j.Backend, j.Status, j.Attempts)
+		}
+		return nil
+	case "status", "logs":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("usage: githook jobs %s <uuid>", sub)
+		}
+		job, err := store.Get(ctx, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if sub == "status" {
+			fmt.Printf("%s\t%s\tattempts=%d\tnext_run_at=%s\n", job.UUID, job.Status, job.Attempts, job.NextRunAt.Format(time.RFC3339))
+			return nil
+		}
+		if job.Response != "" {
+			fmt.Println(ci.DefaultRedactor.Redact(job.Response))
+		}
+		if job.Error != "" {
+			fmt.Fprintln(os.Stderr, ci.DefaultRedactor.Redact(job.Error))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown jobs subcommand %q", sub)
+	}
+}
+
+// jobsHandler serves GET /jobs and GET /jobs/{uuid} as JSON.
+func jobsHandler(store *jobqueue.Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := store.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, j := range jobs {
+			redactJob(j)
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		uuid := r.URL.Path[len("/jobs/"):]
+		job, err := store.Get(r.Context(), uuid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		redactJob(job)
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	})
+	return mux
+}
+
+// redactJob scrubs known secrets from a job's Response/Error before it's
+// serialized for an operator, as a second line of defense behind the
+// per-dispatcher redaction in internal/ci.
+func redactJob(j *jobqueue.Job) {
+	j.Response = ci.DefaultRedactor.Redact(j.Response)
+	j.Error = ci.DefaultRedactor.Redact(j.Error)
+}
@@ -1,16 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
-	"log"
 	"log/slog"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,62 +12,36 @@ import (
 	"strings"
 
 	"cuelang.org/go/cue/cuecontext"
-)
-
-type CIConfig struct {
-	Tekton struct {
-		Pipeline string `json:"pipeline"`
-	} `json:"tekton"`
-}
-
-type TektonPayload struct {
-	Repo           string `json:"repo"`
-	Branch         string `json:"branch"`
-	Commit         string `json:"commit"`
-	Message        string `json:"message"`
-	Author         string `json:"author"`
-	Email          string `json:"email"`
-	TektonPipeline string `json:"tektonPipeline,omitempty"`
-}
 
-type TektonResponse struct {
-	EventListenerUID string `json:"eventListenerUID"`
-	EventID          string `json:"eventID"`
-}
-
-type BuildkitePayload struct {
-	Commit  string `json:"commit"`
-	Branch  string `json:"branch"`
-	Message string `json:"message"`
-	Author  Author `json:"author"`
-}
-type Author struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-}
-type Response struct {
-	WebURL string `json:"web_url"`
-	State  string `json:"state"`
-}
+	"github.com/erred/githook/internal/ci"
+	"github.com/erred/githook/internal/jobqueue"
+)
 
 func main() {
 	ctx := context.Background()
-	lg := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{}))
+	lg := slog.New(slog.NewTextHandler(ci.NewRedactingWriter(os.Stderr, ci.DefaultRedactor), &slog.HandlerOptions{}))
 	err := run(ctx, lg)
 	if err != nil {
 		lg.LogAttrs(ctx, slog.LevelError, "failed", slog.String("error", err.Error()))
 	}
 }
 
+// run enqueues one job per configured CI backend and returns immediately; it
+// never calls out to a CI backend itself. A background `githook daemon`
+// drains the queue with retry and backoff.
 func run(ctx context.Context, lg *slog.Logger) error {
-	n, _ := strconv.ParseInt(os.Getenv("GIT_PUSH_OPTION_COUNT"), 10, 64)
-	pushOptions := make(map[string]string)
-	for i := 0; i < int(n); i++ {
-		k, v, _ := strings.Cut(os.Getenv(fmt.Sprintf("GIT_PUSH_OPTION_%d", i)), "=")
-		pushOptions[k] = v
-	}
+	pushOptions := parsePushOptions()
 
-	if _, ok := pushOptions["ci.skip"]; ok {
+	skipAll := false
+	skip := make(map[string]bool)
+	for _, v := range pushOptions["ci.skip"] {
+		if v == "" {
+			skipAll = true
+			continue
+		}
+		skip[v] = true
+	}
+	if skipAll {
 		lg.LogAttrs(ctx, slog.LevelInfo, "skipping ci", slog.String("push.option", "ci.skip"))
 		return nil
 	}
@@ -92,162 +60,105 @@ func run(ctx context.Context, lg *slog.Logger) error {
 		return err
 	}
 
-	commit := newRev
-	branch := mustExecGit(`rev-parse`, `--abbrev-ref`, refName)
-	message := mustExecGit(`log`, `-1`, `HEAD`, `--format=%B`, `--`)
-	author := mustExecGit(`log`, `-1`, `HEAD`, `--format=%an`, `--`)
-	email := mustExecGit(`log`, `-1`, `HEAD`, `--format=%ae`, `--`)
-	ciConfig, err := readCIConfig(newRev)
+	branch, err := execGit("rev-parse", "--abbrev-ref", refName)
 	if err != nil {
-		lg.LogAttrs(ctx, slog.LevelWarn, "failed to get ci.cue", slog.String("error", err.Error()))
+		lg.LogAttrs(ctx, slog.LevelError, "failed to resolve branch", slog.String("error", err.Error()))
+		return err
+	}
+	message, err := execGit("log", "-1", "HEAD", "--format=%B", "--")
+	if err != nil {
+		lg.LogAttrs(ctx, slog.LevelError, "failed to read commit message", slog.String("error", err.Error()))
+		return err
+	}
+	author, err := execGit("log", "-1", "HEAD", "--format=%an", "--")
+	if err != nil {
+		lg.LogAttrs(ctx, slog.LevelError, "failed to read commit author", slog.String("error", err.Error()))
+		return err
+	}
+	email, err := execGit("log", "-1", "HEAD", "--format=%ae", "--")
+	if err != nil {
+		lg.LogAttrs(ctx, slog.LevelError, "failed to read commit email", slog.String("error", err.Error()))
+		return err
 	}
 
-	// buildkite
-	buildkiteResponse, err := func() (string, error) {
-		org := os.Getenv("BUILDKITE_ORG_SLUG")
-		if org == "" {
-			return "", errors.New("no BUILDKITE_ORG_SLUG found")
-		}
-
-		token := os.Getenv("BUILDKITE_API_TOKEN")
-		if token == "" {
-			return "", errors.New("no BUILDKITE_API_TOKEN found")
-		}
-
-		repoName := strings.ReplaceAll(repoName, ".", "-dot-")
-
-		payload := BuildkitePayload{
-			Commit:  commit,
-			Branch:  branch,
-			Message: message,
-			Author: Author{
-				Name:  author,
-				Email: email,
-			},
-		}
+	ev := ci.PushEvent{
+		RepoName: repoName,
+		Branch:   branch,
+		Commit:   newRev,
+		Message:  message,
+		Author:   author,
+		Email:    email,
+	}
 
-		b, err := json.Marshal(payload)
-		if err != nil {
-			lg.LogAttrs(ctx, slog.LevelError, "failed to marshal payload", slog.String("error", err.Error()))
-			return "", err
-		}
-		u := url.URL{
-			Scheme: "https",
-			Host:   "api.buildkite.com",
-			Path:   fmt.Sprintf("/v2/organizations/%s/pipelines/%s/builds", org, repoName),
-		}
-		req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(b))
-		if err != nil {
-			lg.LogAttrs(ctx, slog.LevelError, "failed to create request", slog.String("error", err.Error()))
-			return "", err
-		}
-		req.Header.Set("content-type", "application/json")
-		req.Header.Set("authorization", "Bearer "+token)
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			lg.LogAttrs(ctx, slog.LevelError, "failed to send request to buildkite", slog.String("org", org), slog.String("repo_name", repoName), slog.String("error", err.Error()))
-			return "", err
-		}
-		if res.StatusCode < 200 || res.StatusCode > 299 {
-			io.Copy(os.Stdout, res.Body)
-			fmt.Println()
-			log.Println("url", u.String())
-			log.Println("body", string(b))
-			log.Fatalln("unexpected response from buildkite", res.Status)
-		}
-		var response Response
-		err = json.NewDecoder(res.Body).Decode(&response)
-		if err != nil {
-			lg.LogAttrs(ctx, slog.LevelError, "failed to read response", slog.String("error", err.Error()))
-			return "", err
-		}
-		lg.LogAttrs(ctx, slog.LevelDebug, "got response", slog.String("state", response.State), slog.String("web_url", response.WebURL))
+	ciConfig, err := readCIConfig(newRev)
+	if err != nil {
+		lg.LogAttrs(ctx, slog.LevelWarn, "failed to get ci.cue", slog.String("error", err.Error()))
+	}
 
-		return response.State + ":\t" + response.WebURL, nil
-	}()
+	store, err := jobqueue.Open(filepath.Join(dir, "githook.db"))
 	if err != nil {
-		lg.LogAttrs(ctx, slog.LevelError, "send to buildkite", slog.String("error", err.Error()))
-		buildkiteResponse = err.Error()
+		return fmt.Errorf("open job store: %w", err)
 	}
+	defer store.Close()
 
-	// tekton
-	tektonResponse, err := func() (string, error) {
-		endpoint := os.Getenv("TEKTON_TRIGGERS_ENDPOINT")
-		if endpoint == "" {
-			return "", fmt.Errorf("no TEKTON_TRIGGERS_ENDPOINT provided")
+	fmt.Println()
+	for _, b := range ci.ResolveBackends(ciConfig) {
+		d := ci.NewDispatcher(b)
+		if d == nil {
+			lg.LogAttrs(ctx, slog.LevelWarn, "unknown backend type", slog.String("type", b.Type))
+			continue
 		}
-
-		payload := TektonPayload{
-			Repo:           repoName,
-			Branch:         branch,
-			Commit:         commit,
-			Message:        message,
-			Author:         author,
-			Email:          email,
-			TektonPipeline: ciConfig.Tekton.Pipeline,
+		if skip[d.Name()] {
+			lg.LogAttrs(ctx, slog.LevelInfo, "skipping backend", slog.String("push.option", "ci.skip"), slog.String("backend", d.Name()))
+			continue
 		}
 
-		b, err := json.Marshal(payload)
-		if err != nil {
-			lg.LogAttrs(ctx, slog.LevelError, "failed to marshal payload", slog.String("error", err.Error()))
-			return "", err
-		}
-		req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(b))
-		if err != nil {
-			lg.LogAttrs(ctx, slog.LevelError, "failed to create request", slog.String("error", err.Error()))
-			return "", err
-		}
-		req.Header.Set("content-type", "application/json")
-		res, err := http.DefaultClient.Do(req)
+		payload, err := json.Marshal(ci.DispatchJob{Config: b, Event: ev})
 		if err != nil {
-			lg.LogAttrs(ctx, slog.LevelError, "failed to send request to tekton", slog.String("error", err.Error()))
-			return "", err
-		}
-		if res.StatusCode < 200 || res.StatusCode > 299 {
-			io.Copy(os.Stdout, res.Body)
-			fmt.Println()
-			log.Println("body", string(b))
-			log.Fatalln("unexpected response from tekton", res.Status)
+			lg.LogAttrs(ctx, slog.LevelError, "marshal job payload", slog.String("backend", d.Name()), slog.String("error", err.Error()))
+			continue
 		}
-		var response TektonResponse
-		err = json.NewDecoder(res.Body).Decode(&response)
+		uuid, err := store.Enqueue(ctx, d.Name(), payload)
 		if err != nil {
-			lg.LogAttrs(ctx, slog.LevelError, "failed to read response", slog.String("error", err.Error()))
-			return "", err
+			lg.LogAttrs(ctx, slog.LevelError, "enqueue job", slog.String("backend", d.Name()), slog.String("error", err.Error()))
+			continue
 		}
-		lg.LogAttrs(ctx, slog.LevelDebug, "got response", slog.String("eventlistener_uid", response.EventListenerUID), slog.String("event_id", response.EventID))
-
-		return "event-id:\t" + response.EventID, nil
-	}()
-	if err != nil {
-		lg.LogAttrs(ctx, slog.LevelError, "send to tekton", slog.String("error", err.Error()))
+		fmt.Printf("\t%s: queued %s\n", d.Name(), uuid)
 	}
-
-	fmt.Println()
-	fmt.Printf("\tbuildkite: %s\n", buildkiteResponse)
-	fmt.Printf("\ttekton: %s\n", tektonResponse)
 	fmt.Println()
 	return nil
 }
 
-func mustExecGit(args ...string) string {
+// parsePushOptions reads GIT_PUSH_OPTION_COUNT / GIT_PUSH_OPTION_N and groups
+// values by key, since push options like `ci.skip` may be passed more than
+// once in a single push.
+func parsePushOptions() map[string][]string {
+	n, _ := strconv.ParseInt(os.Getenv("GIT_PUSH_OPTION_COUNT"), 10, 64)
+	pushOptions := make(map[string][]string)
+	for i := 0; i < int(n); i++ {
+		k, v, _ := strings.Cut(os.Getenv(fmt.Sprintf("GIT_PUSH_OPTION_%d", i)), "=")
+		pushOptions[k] = append(pushOptions[k], v)
+	}
+	return pushOptions
+}
+
+func execGit(args ...string) (string, error) {
 	b, err := exec.Command("git", args...).CombinedOutput()
 	if err != nil {
-		log.Println("output", string(b))
-		log.Fatalln("run git", args, err)
+		return "", fmt.Errorf("run git %v: %w\noutput: %s", args, err, b)
 	}
-	return strings.TrimSpace(string(b))
+	return strings.TrimSpace(string(b)), nil
 }
 
-func readCIConfig(rev string) (CIConfig, error) {
+func readCIConfig(rev string) (ci.Config, error) {
 	b, err := exec.Command("git", "cat-file", rev+":"+"ci.cue").CombinedOutput()
 	if err != nil {
-		return CIConfig{}, fmt.Errorf("git cat-file %s:ci.cue: %w", rev, err)
+		return ci.Config{}, fmt.Errorf("git cat-file %s:ci.cue: %w", rev, err)
 	}
-	var ciConfig CIConfig
+	var ciConfig ci.Config
 	err = cuecontext.New().CompileBytes(b).Decode(&ciConfig)
 	if err != nil {
-		return CIConfig{}, fmt.Errorf("cue decode ci.cue: %w", err)
+		return ci.Config{}, fmt.Errorf("cue decode ci.cue: %w", err)
 	}
 	return ciConfig, nil
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeToolConfigs(t *testing.T) {
+	defaults := []ToolConfig{
+		{Name: "prettier", Match: []string{"*.md"}, Command: []string{"prettier", "-w"}},
+		{Name: "gofumpt", Match: []string{"*.go"}, Command: []string{"gofumpt", "-w"}},
+	}
+
+	t.Run("override by name", func(t *testing.T) {
+		got := mergeToolConfigs(defaults, []ToolConfig{
+			{Name: "gofumpt", Match: []string{"*.go"}, Command: []string{"gofumpt", "-w", "-extra"}},
+		})
+		want := []ToolConfig{
+			defaults[0],
+			{Name: "gofumpt", Match: []string{"*.go"}, Command: []string{"gofumpt", "-w", "-extra"}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mergeToolConfigs override = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("disable by empty command", func(t *testing.T) {
+		got := mergeToolConfigs(defaults, []ToolConfig{
+			{Name: "gofumpt"},
+		})
+		want := []ToolConfig{defaults[0]}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mergeToolConfigs disable = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("append unknown name", func(t *testing.T) {
+		extra := ToolConfig{Name: "shfmt", Match: []string{"*.sh"}, Command: []string{"shfmt", "-w"}}
+		got := mergeToolConfigs(defaults, []ToolConfig{extra})
+		want := append(append([]ToolConfig{}, defaults...), extra)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mergeToolConfigs append = %+v, want %+v", got, want)
+		}
+	})
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
-	"errors"
+	"flag"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"syscall"
+
+	"cuelang.org/go/cue/cuecontext"
 )
 
 var debug = os.Getenv("DEBUG") == "1"
@@ -19,156 +25,360 @@ func main() {
 	ctx, done := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer done()
 
-	err := run(ctx)
+	j := flag.Int("j", runtime.GOMAXPROCS(0), "number of tools to run concurrently")
+	full := flag.Bool("full", false, "run tools against the whole tree instead of just staged changes")
+	flag.Parse()
+
+	err := run(ctx, *j, !*full)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "pre-commit", err)
 		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) error {
-	tools, err := selectTools()
+func run(ctx context.Context, concurrency int, incremental bool) error {
+	tools, err := selectTools(incremental)
 	if err != nil {
 		return err
 	}
+	if len(tools) == 0 {
+		return nil
+	}
 
-	for i, tool := range tools {
+	lg := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{}))
+	return runDAG(ctx, tools, concurrency, lg)
+}
+
+type tool struct {
+	name      string
+	run       func(ctx context.Context) ([]byte, error)
+	allowFail bool
+	dependsOn []string
+}
+
+// toolScope controls how a ToolConfig's command is scoped down to the files
+// a run actually needs to touch.
+type toolScope string
+
+const (
+	// scopeNone always uses FullTarget, regardless of --full/incremental.
+	scopeNone toolScope = "none"
+	// scopeFiles appends the matched file paths directly (prettier, cue fmt,
+	// gofumpt, terraform fmt) in incremental mode, or FullTarget in full mode.
+	scopeFiles toolScope = "files"
+	// scopePackages appends "./dir/..." for each directory containing a
+	// matched file (go vet, staticcheck, go build) in incremental mode, or
+	// FullTarget in full mode.
+	scopePackages toolScope = "packages"
+)
+
+// ToolConfig is one entry of githook.cue's `tools` list, or of the built-in
+// default set. Name identifies the tool for override/disable purposes; Match
+// is a set of globs (matched against repo-relative paths) that must have at
+// least one hit for the tool to run.
+type ToolConfig struct {
+	Name       string    `json:"name"`
+	Match      []string  `json:"match"`
+	Command    []string  `json:"command"`
+	FullTarget []string  `json:"fullTarget,omitempty"`
+	Scope      toolScope `json:"scope,omitempty"`
+	AllowFail  bool      `json:"allowFail,omitempty"`
+	WorkDir    string    `json:"workDir,omitempty"`
+	DependsOn  []string  `json:"dependsOn,omitempty"`
+}
+
+// GithookConfig is decoded from a repo-level githook.cue. Tools declared here
+// are merged into the built-in defaults by Name: a tool with a matching name
+// overrides the default, and a tool with a matching name and an empty
+// Command disables the default entirely.
+type GithookConfig struct {
+	Tools []ToolConfig `json:"tools"`
+}
+
+func defaultToolConfigs() []ToolConfig {
+	return []ToolConfig{
+		{
+			Name:       "prettier",
+			Match:      []string{"*.css", "*.html", "*.json", "*.md", "*.yaml"},
+			Command:    []string{"prettier", "-w"},
+			FullTarget: []string{"."},
+			Scope:      scopeFiles,
+		},
+		{
+			Name:       "cue fmt",
+			Match:      []string{"*.cue"},
+			Command:    []string{"cue", "fmt"},
+			FullTarget: []string{"."},
+			Scope:      scopeFiles,
+		},
+		{
+			Name:       "terraform fmt",
+			Match:      []string{"*.tf"},
+			Command:    []string{"terraform", "fmt", "-write"},
+			FullTarget: []string{"-recursive", "."},
+			Scope:      scopeFiles,
+		},
+		{
+			Name:    "go mod tidy",
+			Match:   []string{"*.go"},
+			Command: []string{"go", "mod", "tidy"},
+			Scope:   scopeNone,
+		},
+		{
+			Name:       "gofumpt",
+			Match:      []string{"*.go"},
+			Command:    []string{"gofumpt", "-w"},
+			FullTarget: []string{"."},
+			Scope:      scopeFiles,
+			DependsOn:  []string{"go mod tidy"},
+		},
+		{
+			Name:       "go vet",
+			Match:      []string{"*.go"},
+			Command:    []string{"go", "vet"},
+			FullTarget: []string{"./..."},
+			Scope:      scopePackages,
+			DependsOn:  []string{"go mod tidy"},
+		},
+		{
+			Name:       "staticcheck",
+			Match:      []string{"*.go"},
+			Command:    []string{"staticcheck"},
+			FullTarget: []string{"./..."},
+			Scope:      scopePackages,
+			DependsOn:  []string{"go mod tidy"},
+		},
+		{
+			Name:       "go build",
+			Match:      []string{"*.go"},
+			Command:    []string{"go", "build", "-o", "/dev/null"},
+			FullTarget: []string{"./..."},
+			Scope:      scopePackages,
+			DependsOn:  []string{"go mod tidy"},
+		},
+	}
+}
+
+func selectTools(incremental bool) ([]tool, error) {
+	files, err := treeFiles(incremental)
+	if err != nil {
+		return nil, fmt.Errorf("select tools: %w", err)
+	}
+
+	configs := defaultToolConfigs()
+	userConfigs, err := readGithookConfig()
+	if err != nil {
 		if debug {
-			fmt.Fprintln(os.Stderr, "running tool", i, tool.name)
+			fmt.Fprintln(os.Stderr, "pre-commit: no githook.cue:", err)
+		}
+	} else {
+		configs = mergeToolConfigs(configs, userConfigs.Tools)
+	}
+
+	var tools []tool
+	var names []string
+	var touchedAny bool
+	for _, c := range configs {
+		matched := matchFiles(files, c.Match)
+		if len(matched) == 0 {
+			continue
 		}
-		out, err := tool.run(ctx)
-		var exit *exec.ExitError
-		if errors.As(err, &exit) {
-			if tool.allowfail {
+		tools = append(tools, toolFromConfig(c, matched, incremental))
+		names = append(names, c.Name)
+		if c.Scope == scopeFiles {
+			touchedAny = true
+		}
+	}
+
+	if len(tools) > 0 && (!incremental || touchedAny) {
+		// In incremental mode only the files tools actually rewrote need
+		// re-adding; in full mode `git add .` matches the historical behavior.
+		tools = append(tools, tool{
+			name: "git add",
+			run: func(ctx context.Context) ([]byte, error) {
+				args := []string{"add", "."}
+				if incremental {
+					args = append([]string{"add", "--"}, matchFiles(files, allGlobs(configs))...)
+				}
+				return exec.CommandContext(ctx, "git", args...).CombinedOutput()
+			},
+			dependsOn: names,
+		})
+	}
+	return tools, nil
+}
+
+func allGlobs(configs []ToolConfig) []string {
+	var globs []string
+	for _, c := range configs {
+		if c.Scope == scopeFiles {
+			globs = append(globs, c.Match...)
+		}
+	}
+	return globs
+}
+
+// mergeToolConfigs overrides or appends to defaults by Name; a user entry
+// with an empty Command disables the default of the same Name.
+func mergeToolConfigs(defaults, overrides []ToolConfig) []ToolConfig {
+	byName := make(map[string]int, len(defaults))
+	merged := make([]ToolConfig, len(defaults))
+	copy(merged, defaults)
+	for i, c := range merged {
+		byName[c.Name] = i
+	}
+
+	for _, o := range overrides {
+		if i, ok := byName[o.Name]; ok {
+			if len(o.Command) == 0 {
+				merged[i] = ToolConfig{Name: o.Name} // disabled below
 				continue
 			}
-			return fmt.Errorf("tool %d %q exited with nonzero status %d, out:\n%s", i, tool.name, exit.ExitCode(), out)
-		} else if err != nil {
-			return fmt.Errorf("tool %d %q unexpected error: %w", i, tool.name, err)
+			merged[i] = o
+			continue
 		}
+		byName[o.Name] = len(merged)
+		merged = append(merged, o)
 	}
-	return nil
+
+	result := merged[:0]
+	for _, c := range merged {
+		if len(c.Command) == 0 {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
 }
 
-type tool struct {
-	name      string
-	run       func(ctx context.Context) ([]byte, error)
-	allowfail bool
+func toolFromConfig(c ToolConfig, matched []string, incremental bool) tool {
+	if c.Scope == "" {
+		c.Scope = scopeNone // custom tools default to running Command/FullTarget verbatim
+	}
+	return tool{
+		name:      c.Name,
+		allowFail: c.AllowFail,
+		dependsOn: c.DependsOn,
+		run: func(ctx context.Context) ([]byte, error) {
+			args := append([]string{}, c.Command[1:]...)
+			switch {
+			case c.Scope == scopeNone || !incremental:
+				args = append(args, c.FullTarget...)
+			case c.Scope == scopeFiles:
+				args = append(args, matched...)
+			case c.Scope == scopePackages:
+				args = append(args, packagePatterns(matched)...)
+			}
+			cmd := exec.CommandContext(ctx, c.Command[0], args...)
+			if c.WorkDir != "" {
+				cmd.Dir = c.WorkDir
+			}
+			return cmd.CombinedOutput()
+		},
+	}
+}
+
+// packagePatterns turns a set of changed Go file paths into one sorted
+// "./dir/..." pattern per directory containing them, or just "./..." if any
+// file is at the repo root. A directory nested under another listed one
+// still gets its own pattern.
+func packagePatterns(files []string) []string {
+	dirs := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if dir == "." {
+			return []string{"./..."}
+		}
+		dirs[dir] = struct{}{}
+	}
+	patterns := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		patterns = append(patterns, "./"+dir+"/...")
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// treeFiles lists the files tools should consider: every file in the working
+// tree in full mode, or just the staged changes in incremental mode.
+func treeFiles(incremental bool) ([]string, error) {
+	if incremental {
+		return changedFiles()
+	}
+	return walkFiles()
 }
 
-func selectTools() ([]tool, error) {
-	var cuefiles, gofiles []string
-	var prettier, terraform bool
+// changedFiles returns staged files (added, copied, modified, renamed) via
+// `git diff --cached --name-only --diff-filter=ACMR`, which compares the
+// index against HEAD, or against the empty tree on the very first commit.
+func changedFiles() ([]string, error) {
+	out, err := exec.Command("git", "diff", "--cached", "--name-only", "--diff-filter=ACMR").CombinedOutput()
+	if err != nil {
+		// No HEAD yet: diff the index against git's well-known empty tree.
+		const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+		out, err = exec.Command("git", "diff", "--cached", "--name-only", "--diff-filter=ACMR", emptyTree).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("git diff --cached: %w, out: %s", err, out)
+		}
+	}
+	s := strings.TrimSpace(string(out))
+	if s == "" {
+		return nil, nil
+	}
+	return strings.Split(s, "\n"), nil
+}
+
+// walkFiles lists every repo-relative path under the working tree, skipping
+// .git, for glob matching against ToolConfig.Match.
+func walkFiles() ([]string, error) {
+	var files []string
 	err := filepath.WalkDir(".", func(p string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
 			if d.Name() == ".git" {
 				return fs.SkipDir
 			}
-			return err
-		}
-		switch filepath.Ext(d.Name()) {
-		case ".css", ".html", ".json", ".md", ".yaml":
-			prettier = true
-		case ".go":
-			gofiles = append(gofiles, p)
-		case ".cue":
-			fmt.Println(p, d.Name())
-			cuefiles = append(cuefiles, p)
-		case ".tf":
-			terraform = true
+			return nil
 		}
+		files = append(files, p)
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("select tools: walk over '.': %w", err)
+		return nil, fmt.Errorf("walk over '.': %w", err)
 	}
+	return files, nil
+}
 
-	var tools []tool
-	if prettier {
-		tools = append(tools, tool{
-			name: "prettier",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"prettier", "-w", ".",
-				).CombinedOutput()
-			},
-		})
-	}
-	if len(cuefiles) > 0 {
-		tools = append(tools, tool{
-			name: "cue fmt",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"cue", append([]string{"fmt"}, cuefiles...)...,
-				).CombinedOutput()
-			},
-		})
-	}
-	if terraform {
-		tools = append(tools, tool{
-			name: "terraform fmt",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"terraform", "fmt", "-write", "-recursive", ".",
-				).CombinedOutput()
-			},
-		})
-	}
-	if len(gofiles) > 0 {
-		godirsm := make(map[string]struct{})
-		for _, dir := range gofiles {
-			godirsm[filepath.Dir(dir)] = struct{}{}
-		}
-		godirs := make([]string, 0, len(godirsm))
-		for dir := range godirsm {
-			godirs = append(godirs, dir)
+// matchFiles returns the files matching any of the given globs, compared
+// against both the full repo-relative path and the bare filename.
+func matchFiles(files []string, globs []string) []string {
+	var matched []string
+	for _, f := range files {
+		for _, g := range globs {
+			if ok, _ := filepath.Match(g, f); ok {
+				matched = append(matched, f)
+				break
+			}
+			if ok, _ := filepath.Match(g, filepath.Base(f)); ok {
+				matched = append(matched, f)
+				break
+			}
 		}
-		tools = append(tools, tool{
-			name: "go mod tidy",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"go", "mod", "tidy",
-				).CombinedOutput()
-			},
-		}, tool{
-			name: "gofumpt",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"gofumpt", append([]string{"-w"}, godirs...)...,
-				).CombinedOutput()
-			},
-		}, tool{
-			name: "go vet",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"go", "vet", "./...",
-				).CombinedOutput()
-			},
-		}, tool{
-			name: "staticcheck",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"staticcheck", "./...",
-				).CombinedOutput()
-			},
-		}, tool{
-			name: "go build",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"go", "build", "-o", "/dev/null", "./...",
-				).CombinedOutput()
-			},
-		})
 	}
-	if len(tools) > 0 {
-		tools = append(tools, tool{
-			name: "git commit",
-			run: func(ctx context.Context) ([]byte, error) {
-				return exec.CommandContext(ctx,
-					"git", "add", ".",
-				).CombinedOutput()
-			},
-		})
+	return matched
+}
+
+func readGithookConfig() (GithookConfig, error) {
+	b, err := os.ReadFile("githook.cue")
+	if err != nil {
+		return GithookConfig{}, fmt.Errorf("read githook.cue: %w", err)
 	}
-	return tools, nil
+	var cfg GithookConfig
+	err = cuecontext.New().CompileBytes(b).Decode(&cfg)
+	if err != nil {
+		return GithookConfig{}, fmt.Errorf("cue decode githook.cue: %w", err)
+	}
+	return cfg, nil
 }
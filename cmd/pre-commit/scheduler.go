@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// node is the scheduler's view of a tool: its place in the dependency graph
+// plus the live status rendered by the table (or logged via slog).
+type node struct {
+	tool
+	dependents []string
+	remaining  int
+	status     nodeStatus
+	start      time.Time
+	elapsed    time.Duration
+	err        error
+	// output is the failed tool's combined output, captured instead of
+	// printed immediately in live-table mode so it can be dumped after the
+	// table stops redrawing rather than interleaved with it.
+	output []byte
+}
+
+type nodeStatus int
+
+const (
+	statusPending nodeStatus = iota
+	statusRunning
+	statusSuccess
+	statusFailed
+	statusSkipped
+)
+
+func (s nodeStatus) String() string {
+	switch s {
+	case statusPending:
+		return "pending"
+	case statusRunning:
+		return "running"
+	case statusSuccess:
+		return "ok"
+	case statusFailed:
+		return "failed"
+	case statusSkipped:
+		return "skipped"
+	default:
+		return "unknown"
+	}
+}
+
+// runDAG runs tools concurrently, bounded by concurrency, respecting
+// tool.dependsOn. A dependency named in dependsOn that isn't among tools is
+// treated as already satisfied. When a tool fails (and isn't allowFail), its
+// transitive dependents are skipped rather than started, but unrelated
+// branches keep running.
+func runDAG(ctx context.Context, tools []tool, concurrency int, lg *slog.Logger) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	order := make([]string, 0, len(tools))
+	nodes := make(map[string]*node, len(tools))
+	for _, t := range tools {
+		nodes[t.name] = &node{tool: t}
+		order = append(order, t.name)
+	}
+	for _, n := range nodes {
+		for _, dep := range n.dependsOn {
+			if depNode, ok := nodes[dep]; ok {
+				n.remaining++
+				depNode.dependents = append(depNode.dependents, n.name)
+			}
+		}
+	}
+
+	live := isLiveTTY()
+	done := make(chan struct{})
+
+	var mu sync.Mutex
+	var tableStopped <-chan struct{}
+	if live {
+		tableStopped = startLiveTable(order, nodes, &mu, done)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	var launch func(name string)
+	var finish func(name string, out []byte, err error)
+
+	launch = func(name string) {
+		n := nodes[name]
+		mu.Lock()
+		n.status = statusRunning
+		n.start = time.Now()
+		mu.Unlock()
+		if !live {
+			lg.LogAttrs(ctx, slog.LevelInfo, "tool start", slog.String("tool", name))
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			out, err := n.run(ctx)
+			finish(name, out, err)
+		}()
+	}
+
+	finish = func(name string, out []byte, err error) {
+		n := nodes[name]
+		var exit interface{ ExitCode() int }
+		failed := errors.As(err, &exit) && !n.allowFail
+		unexpected := err != nil && exit == nil
+
+		mu.Lock()
+		n.elapsed = time.Since(n.start)
+		n.err = err
+		switch {
+		case failed || unexpected:
+			n.status = statusFailed
+			n.output = out
+		default:
+			n.status = statusSuccess
+		}
+		dependents := append([]string(nil), n.dependents...)
+		mu.Unlock()
+
+		if !live {
+			attrs := []slog.Attr{slog.String("tool", name), slog.Duration("duration", n.elapsed)}
+			if exit != nil {
+				attrs = append(attrs, slog.Int("exit_code", exit.ExitCode()))
+			}
+			if n.status == statusFailed {
+				lg.LogAttrs(ctx, slog.LevelError, "tool finished", attrs...)
+			} else {
+				lg.LogAttrs(ctx, slog.LevelInfo, "tool finished", attrs...)
+			}
+			if n.status == statusFailed {
+				dumpFailure(name, out)
+			}
+		}
+
+		ready, skipped := settleDependents(nodes, &mu, dependents, n.status == statusFailed)
+		for _, s := range skipped {
+			if !live {
+				lg.LogAttrs(ctx, slog.LevelWarn, "tool skipped", slog.String("tool", s), slog.String("reason", "dependency failed"))
+			}
+		}
+		for _, r := range ready {
+			launch(r)
+		}
+	}
+
+	mu.Lock()
+	var initial []string
+	for _, name := range order {
+		if nodes[name].remaining == 0 {
+			initial = append(initial, name)
+		}
+	}
+	mu.Unlock()
+	for _, name := range initial {
+		launch(name)
+	}
+
+	wg.Wait()
+	close(done)
+	if live {
+		// Wait for the table's last redraw before dumping any failure
+		// output, so the dump never lands mid-frame and throws off the
+		// next redraw's cursor-up count.
+		<-tableStopped
+	}
+
+	var failures []error
+	for _, name := range order {
+		n := nodes[name]
+		if n.status == statusFailed {
+			if live {
+				dumpFailure(name, n.output)
+			}
+			failures = append(failures, fmt.Errorf("tool %q: %w", name, n.err))
+		}
+	}
+	return errors.Join(failures...)
+}
+
+// settleDependents decrements the remaining-dependency count of each
+// dependent of a just-finished node. If the node failed, every dependent (and
+// transitively, theirs) is marked skipped instead. Returns the dependents
+// that are now ready to launch, and the ones that were skipped.
+func settleDependents(nodes map[string]*node, mu *sync.Mutex, dependents []string, parentFailed bool) (ready, skipped []string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	queue := append([]string(nil), dependents...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		n := nodes[name]
+
+		if parentFailed {
+			if n.status == statusSkipped {
+				continue
+			}
+			n.status = statusSkipped
+			skipped = append(skipped, name)
+			queue = append(queue, n.dependents...)
+			continue
+		}
+
+		n.remaining--
+		if n.remaining == 0 && n.status == statusPending {
+			ready = append(ready, name)
+		}
+	}
+	return ready, skipped
+}
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	s := string(b)
+	var lines []string
+	start := 0
+	for i, c := range s {
+		if c == '\n' {
+			lines = append(lines, s[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		lines = append(lines, s[start:])
+	}
+	return lines
+}
+
+func isLiveTTY() bool {
+	return term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+var spinnerFrames = []rune("⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏")
+
+// startLiveTable repaints a status table on os.Stderr every 150ms until done
+// is closed, then returns (closing the returned channel) after its final
+// redraw. mu is runDAG's own mutex, the same one launch/finish lock around
+// n.status/n.start/n.elapsed, so the redraw goroutine never reads those
+// fields while a tool goroutine is mutating them. Callers that need to write
+// to os.Stderr themselves (e.g. dumping a failed tool's output) must wait for
+// the returned channel first, or their write can land mid-frame and corrupt
+// the next redraw's cursor-up count.
+func startLiveTable(order []string, nodes map[string]*node, mu *sync.Mutex, done <-chan struct{}) <-chan struct{} {
+	redraw := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(os.Stderr, "\x1b[%dA\x1b[J", len(order))
+		for _, name := range order {
+			n := nodes[name]
+			switch n.status {
+			case statusRunning:
+				frame := spinnerFrames[int(time.Since(n.start)/(100*time.Millisecond))%len(spinnerFrames)]
+				fmt.Fprintf(os.Stderr, "%c %-20s running %s\n", frame, name, time.Since(n.start).Round(time.Millisecond))
+			case statusSuccess:
+				fmt.Fprintf(os.Stderr, "✓ %-20s ok %s\n", name, n.elapsed.Round(time.Millisecond))
+			case statusFailed:
+				fmt.Fprintf(os.Stderr, "✗ %-20s failed %s\n", name, n.elapsed.Round(time.Millisecond))
+			case statusSkipped:
+				fmt.Fprintf(os.Stderr, "- %-20s skipped\n", name)
+			default:
+				fmt.Fprintf(os.Stderr, "  %-20s pending\n", name)
+			}
+		}
+	}
+
+	for range order {
+		fmt.Fprintln(os.Stderr)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(150 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				redraw()
+			case <-done:
+				redraw()
+				return
+			}
+		}
+	}()
+	return stopped
+}
+
+// dumpFailure prints a failed tool's captured output to os.Stderr, one line
+// at a time prefixed with its name.
+func dumpFailure(name string, out []byte) {
+	fmt.Fprintf(os.Stderr, "--- %s failed ---\n", name)
+	for _, line := range splitLines(out) {
+		fmt.Fprintf(os.Stderr, "[%s] %s\n", name, line)
+	}
+}
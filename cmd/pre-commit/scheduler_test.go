@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestSettleDependentsSuccess(t *testing.T) {
+	nodes := map[string]*node{
+		"a": {tool: tool{name: "a"}, remaining: 0, dependents: []string{"b", "c"}},
+		"b": {tool: tool{name: "b"}, remaining: 1},
+		"c": {tool: tool{name: "c"}, remaining: 2},
+	}
+	var mu sync.Mutex
+
+	ready, skipped := settleDependents(nodes, &mu, nodes["a"].dependents, false)
+	if skipped != nil {
+		t.Errorf("skipped = %v, want nil", skipped)
+	}
+	want := []string{"b"}
+	if !reflect.DeepEqual(ready, want) {
+		t.Errorf("ready = %v, want %v (c still has a dependency outstanding)", ready, want)
+	}
+	if nodes["c"].remaining != 1 {
+		t.Errorf("c.remaining = %d, want 1", nodes["c"].remaining)
+	}
+}
+
+func TestSettleDependentsPropagatesFailure(t *testing.T) {
+	nodes := map[string]*node{
+		"a": {tool: tool{name: "a"}, dependents: []string{"b"}},
+		"b": {tool: tool{name: "b"}, status: statusPending, dependents: []string{"c"}},
+		"c": {tool: tool{name: "c"}, status: statusPending},
+	}
+	var mu sync.Mutex
+
+	ready, skipped := settleDependents(nodes, &mu, nodes["a"].dependents, true)
+	if ready != nil {
+		t.Errorf("ready = %v, want nil", ready)
+	}
+	sort.Strings(skipped)
+	want := []string{"b", "c"}
+	if !reflect.DeepEqual(skipped, want) {
+		t.Errorf("skipped = %v, want %v (failure skips transitively)", skipped, want)
+	}
+	if nodes["b"].status != statusSkipped || nodes["c"].status != statusSkipped {
+		t.Errorf("b/c status = %v/%v, want both statusSkipped", nodes["b"].status, nodes["c"].status)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackagePatterns(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{
+			name:  "single dir",
+			files: []string{"pkg/foo/a.go", "pkg/foo/b.go"},
+			want:  []string{"./pkg/foo/..."},
+		},
+		{
+			name:  "multiple dirs sorted",
+			files: []string{"pkg/bar/b.go", "pkg/foo/a.go"},
+			want:  []string{"./pkg/bar/...", "./pkg/foo/..."},
+		},
+		{
+			name:  "repo root file widens to everything",
+			files: []string{"main.go", "pkg/foo/a.go"},
+			want:  []string{"./..."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := packagePatterns(tt.files)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("packagePatterns(%v) = %v, want %v", tt.files, got, tt.want)
+			}
+		})
+	}
+}
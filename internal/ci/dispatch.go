@@ -0,0 +1,564 @@
+// Package ci builds and runs the CI backend dispatchers used by the
+// post-receive hook and the githook job daemon.
+package ci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config is decoded from ci.cue at the commit being pushed. It declares the
+// CI backends to fan the push out to; a repo can list as many as it likes and
+// skip individual ones per-push with `-o ci.skip=<type>`.
+type Config struct {
+	Backends []BackendConfig `json:"backends"`
+}
+
+// BackendConfig is one entry of Config.Backends. Type selects which of the
+// typed sub-configs applies; exactly one should be set.
+type BackendConfig struct {
+	Type       string            `json:"type"`
+	Buildkite  *BuildkiteConfig  `json:"buildkite,omitempty"`
+	Tekton     *TektonConfig     `json:"tekton,omitempty"`
+	GitHub     *GitHubConfig     `json:"github,omitempty"`
+	GitLab     *GitLabConfig     `json:"gitlab,omitempty"`
+	Woodpecker *WoodpeckerConfig `json:"woodpecker,omitempty"`
+	Drone      *DroneConfig      `json:"drone,omitempty"`
+}
+
+type BuildkiteConfig struct {
+	Org string `json:"org,omitempty"`
+}
+
+type TektonConfig struct {
+	Pipeline string `json:"pipeline"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+type GitHubConfig struct {
+	Owner    string `json:"owner"`
+	Repo     string `json:"repo"`
+	Workflow string `json:"workflow,omitempty"` // workflow file name, triggers workflow_dispatch
+	Event    string `json:"event,omitempty"`    // event_type, triggers repository_dispatch
+}
+
+type GitLabConfig struct {
+	Host    string `json:"host,omitempty"` // defaults to gitlab.com
+	Project string `json:"project"`        // numeric ID or URL-encoded path
+}
+
+type WoodpeckerConfig struct {
+	Host  string `json:"host"`
+	Owner string `json:"owner"`
+	Repo  string `json:"repo"`
+}
+
+type DroneConfig struct {
+	Host  string `json:"host"`
+	Owner string `json:"owner"`
+	Repo  string `json:"repo"`
+}
+
+// PushEvent carries the information every dispatcher needs about the commit
+// that was pushed.
+type PushEvent struct {
+	RepoName string
+	Branch   string
+	Commit   string
+	Message  string
+	Author   string
+	Email    string
+}
+
+// DispatchResult is the normalized outcome of a single backend dispatch, used
+// to print a uniform summary regardless of which backend produced it.
+type DispatchResult struct {
+	Backend    string
+	URL        string
+	State      string
+	ExternalID string
+	Err        error
+}
+
+func (r DispatchResult) String() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	var parts []string
+	if r.State != "" {
+		parts = append(parts, r.State+":")
+	}
+	if r.URL != "" {
+		parts = append(parts, r.URL)
+	}
+	if r.ExternalID != "" {
+		parts = append(parts, "id:"+r.ExternalID)
+	}
+	return strings.Join(parts, "\t")
+}
+
+// Dispatcher triggers a CI backend for a push and reports back a normalized
+// result. Implementations must not block longer than ctx allows.
+type Dispatcher interface {
+	// Name identifies the backend for logging and for `ci.skip=<name>` push options.
+	Name() string
+	Dispatch(ctx context.Context, lg *slog.Logger, ev PushEvent) DispatchResult
+}
+
+// ResolveBackends returns cfg.Backends, or if empty, the historical default
+// of trying both buildkite and tekton from environment variables alone.
+func ResolveBackends(cfg Config) []BackendConfig {
+	if len(cfg.Backends) > 0 {
+		return cfg.Backends
+	}
+	return []BackendConfig{
+		{Type: "buildkite", Buildkite: &BuildkiteConfig{}},
+		{Type: "tekton", Tekton: &TektonConfig{}},
+	}
+}
+
+// BuildDispatchers turns the parsed ci.cue backends into Dispatchers. Entries
+// with an unknown or mismatched Type are skipped with no dispatcher created.
+func BuildDispatchers(cfg Config) []Dispatcher {
+	var dispatchers []Dispatcher
+	for _, b := range ResolveBackends(cfg) {
+		if d := NewDispatcher(b); d != nil {
+			dispatchers = append(dispatchers, d)
+		}
+	}
+	return dispatchers
+}
+
+// NewDispatcher builds the single Dispatcher described by b, or nil if Type
+// is unknown or its typed sub-config is missing.
+func NewDispatcher(b BackendConfig) Dispatcher {
+	switch b.Type {
+	case "buildkite":
+		if b.Buildkite == nil {
+			return nil
+		}
+		return &BuildkiteDispatcher{Config: b.Buildkite}
+	case "tekton":
+		if b.Tekton == nil {
+			return nil
+		}
+		return &TektonDispatcher{Config: b.Tekton}
+	case "github":
+		if b.GitHub == nil {
+			return nil
+		}
+		return &GitHubDispatcher{Config: b.GitHub}
+	case "gitlab":
+		if b.GitLab == nil {
+			return nil
+		}
+		return &GitLabDispatcher{Config: b.GitLab}
+	case "woodpecker":
+		if b.Woodpecker == nil {
+			return nil
+		}
+		return &WoodpeckerDispatcher{Config: b.Woodpecker}
+	case "drone":
+		if b.Drone == nil {
+			return nil
+		}
+		return &DroneDispatcher{Config: b.Drone}
+	default:
+		return nil
+	}
+}
+
+// DispatchJob is the unit of work handed to the job queue: enough to
+// reconstruct the right Dispatcher and call it, without re-reading ci.cue.
+type DispatchJob struct {
+	Config BackendConfig `json:"config"`
+	Event  PushEvent     `json:"event"`
+}
+
+// Dispatch rebuilds the Dispatcher described by j.Config and runs it.
+func (j DispatchJob) Dispatch(ctx context.Context, lg *slog.Logger) DispatchResult {
+	d := NewDispatcher(j.Config)
+	if d == nil {
+		return DispatchResult{Backend: j.Config.Type, Err: fmt.Errorf("unknown backend type %q", j.Config.Type)}
+	}
+	res := d.Dispatch(ctx, lg, j.Event)
+	res.Backend = d.Name()
+	return res
+}
+
+// BuildkitePayload is the body sent to the Buildkite builds API.
+type BuildkitePayload struct {
+	Commit  string `json:"commit"`
+	Branch  string `json:"branch"`
+	Message string `json:"message"`
+	Author  Author `json:"author"`
+}
+type Author struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+type BuildkiteResponse struct {
+	WebURL string `json:"web_url"`
+	State  string `json:"state"`
+}
+
+type BuildkiteDispatcher struct {
+	Config *BuildkiteConfig
+}
+
+func (d *BuildkiteDispatcher) Name() string { return "buildkite" }
+
+func (d *BuildkiteDispatcher) Dispatch(ctx context.Context, lg *slog.Logger, ev PushEvent) DispatchResult {
+	org := d.Config.Org
+	if org == "" {
+		org = os.Getenv("BUILDKITE_ORG_SLUG")
+	}
+	if org == "" {
+		return DispatchResult{Err: fmt.Errorf("no BUILDKITE_ORG_SLUG found")}
+	}
+
+	token := os.Getenv("BUILDKITE_API_TOKEN")
+	if token == "" {
+		return DispatchResult{Err: fmt.Errorf("no BUILDKITE_API_TOKEN found")}
+	}
+
+	pipeline := strings.ReplaceAll(ev.RepoName, ".", "-dot-")
+
+	payload := BuildkitePayload{
+		Commit:  ev.Commit,
+		Branch:  ev.Branch,
+		Message: ev.Message,
+		Author: Author{
+			Name:  ev.Author,
+			Email: ev.Email,
+		},
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("marshal payload: %w", err)}
+	}
+	u := url.URL{
+		Scheme: "https",
+		Host:   "api.buildkite.com",
+		Path:   fmt.Sprintf("/v2/organizations/%s/pipelines/%s/builds", org, pipeline),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("create request: %w", err)}
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("send request to buildkite: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return DispatchResult{Err: fmt.Errorf("unexpected response from buildkite %s: %s", res.Status, DefaultRedactor.Redact(string(body)))}
+	}
+	var response BuildkiteResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("read response: %w", err)}
+	}
+	lg.LogAttrs(ctx, slog.LevelDebug, "got response", slog.String("state", response.State), slog.String("web_url", response.WebURL))
+	return DispatchResult{URL: response.WebURL, State: response.State}
+}
+
+// TektonPayload is the body sent to the Tekton triggers EventListener.
+type TektonPayload struct {
+	Repo           string `json:"repo"`
+	Branch         string `json:"branch"`
+	Commit         string `json:"commit"`
+	Message        string `json:"message"`
+	Author         string `json:"author"`
+	Email          string `json:"email"`
+	TektonPipeline string `json:"tektonPipeline,omitempty"`
+}
+
+type TektonResponse struct {
+	EventListenerUID string `json:"eventListenerUID"`
+	EventID          string `json:"eventID"`
+}
+
+type TektonDispatcher struct {
+	Config *TektonConfig
+}
+
+func (d *TektonDispatcher) Name() string { return "tekton" }
+
+func (d *TektonDispatcher) Dispatch(ctx context.Context, lg *slog.Logger, ev PushEvent) DispatchResult {
+	endpoint := d.Config.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("TEKTON_TRIGGERS_ENDPOINT")
+	}
+	if endpoint == "" {
+		return DispatchResult{Err: fmt.Errorf("no TEKTON_TRIGGERS_ENDPOINT provided")}
+	}
+
+	payload := TektonPayload{
+		Repo:           ev.RepoName,
+		Branch:         ev.Branch,
+		Commit:         ev.Commit,
+		Message:        ev.Message,
+		Author:         ev.Author,
+		Email:          ev.Email,
+		TektonPipeline: d.Config.Pipeline,
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("marshal payload: %w", err)}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("create request: %w", err)}
+	}
+	req.Header.Set("content-type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("send request to tekton: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return DispatchResult{Err: fmt.Errorf("unexpected response from tekton %s: %s", res.Status, DefaultRedactor.Redact(string(body)))}
+	}
+	var response TektonResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("read response: %w", err)}
+	}
+	lg.LogAttrs(ctx, slog.LevelDebug, "got response", slog.String("eventlistener_uid", response.EventListenerUID), slog.String("event_id", response.EventID))
+	return DispatchResult{ExternalID: response.EventID}
+}
+
+// GitHubDispatcher triggers either a workflow_dispatch (when Config.Workflow
+// is set) or a repository_dispatch (when Config.Event is set) via the GitHub
+// Actions API. The token comes from GITHUB_TOKEN.
+type GitHubDispatcher struct {
+	Config *GitHubConfig
+}
+
+func (d *GitHubDispatcher) Name() string { return "github" }
+
+func (d *GitHubDispatcher) Dispatch(ctx context.Context, lg *slog.Logger, ev PushEvent) DispatchResult {
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return DispatchResult{Err: fmt.Errorf("no GITHUB_TOKEN found")}
+	}
+	if d.Config.Owner == "" || d.Config.Repo == "" {
+		return DispatchResult{Err: fmt.Errorf("github backend requires owner and repo")}
+	}
+
+	var endpoint string
+	var body any
+	switch {
+	case d.Config.Workflow != "":
+		endpoint = fmt.Sprintf("https://api.github.com/repos/%s/%s/actions/workflows/%s/dispatches", d.Config.Owner, d.Config.Repo, d.Config.Workflow)
+		body = struct {
+			Ref string `json:"ref"`
+		}{Ref: ev.Branch}
+	case d.Config.Event != "":
+		endpoint = fmt.Sprintf("https://api.github.com/repos/%s/%s/dispatches", d.Config.Owner, d.Config.Repo)
+		body = struct {
+			EventType     string            `json:"event_type"`
+			ClientPayload map[string]string `json:"client_payload"`
+		}{
+			EventType: d.Config.Event,
+			ClientPayload: map[string]string{
+				"commit":  ev.Commit,
+				"branch":  ev.Branch,
+				"message": ev.Message,
+			},
+		}
+	default:
+		return DispatchResult{Err: fmt.Errorf("github backend requires workflow or event")}
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("marshal payload: %w", err)}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("create request: %w", err)}
+	}
+	req.Header.Set("accept", "application/vnd.github+json")
+	req.Header.Set("authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("send request to github: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		respBody, _ := io.ReadAll(res.Body)
+		return DispatchResult{Err: fmt.Errorf("unexpected response from github %s: %s", res.Status, DefaultRedactor.Redact(string(respBody)))}
+	}
+	lg.LogAttrs(ctx, slog.LevelDebug, "dispatched github workflow", slog.String("owner", d.Config.Owner), slog.String("repo", d.Config.Repo))
+	return DispatchResult{State: "triggered", URL: fmt.Sprintf("https://github.com/%s/%s/actions", d.Config.Owner, d.Config.Repo)}
+}
+
+// GitLabDispatcher triggers a pipeline via the GitLab CI trigger API. The
+// trigger token comes from GITLAB_TRIGGER_TOKEN.
+type GitLabDispatcher struct {
+	Config *GitLabConfig
+}
+
+func (d *GitLabDispatcher) Name() string { return "gitlab" }
+
+func (d *GitLabDispatcher) Dispatch(ctx context.Context, lg *slog.Logger, ev PushEvent) DispatchResult {
+	token := os.Getenv("GITLAB_TRIGGER_TOKEN")
+	if token == "" {
+		return DispatchResult{Err: fmt.Errorf("no GITLAB_TRIGGER_TOKEN found")}
+	}
+	if d.Config.Project == "" {
+		return DispatchResult{Err: fmt.Errorf("gitlab backend requires project")}
+	}
+	host := d.Config.Host
+	if host == "" {
+		host = "gitlab.com"
+	}
+
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("ref", ev.Branch)
+	endpoint := fmt.Sprintf("https://%s/api/v4/projects/%s/trigger/pipeline", host, url.PathEscape(d.Config.Project))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("create request: %w", err)}
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("send request to gitlab: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return DispatchResult{Err: fmt.Errorf("unexpected response from gitlab %s: %s", res.Status, DefaultRedactor.Redact(string(body)))}
+	}
+	var response struct {
+		ID     int    `json:"id"`
+		WebURL string `json:"web_url"`
+		Status string `json:"status"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("read response: %w", err)}
+	}
+	lg.LogAttrs(ctx, slog.LevelDebug, "got response", slog.Int("id", response.ID), slog.String("web_url", response.WebURL))
+	return DispatchResult{URL: response.WebURL, State: response.Status, ExternalID: strconv.Itoa(response.ID)}
+}
+
+// WoodpeckerDispatcher triggers a new pipeline via Woodpecker's
+// /api/repos/{owner}/{repo}/pipelines endpoint. The token comes from
+// WOODPECKER_TOKEN.
+type WoodpeckerDispatcher struct {
+	Config *WoodpeckerConfig
+}
+
+func (d *WoodpeckerDispatcher) Name() string { return "woodpecker" }
+
+func (d *WoodpeckerDispatcher) Dispatch(ctx context.Context, lg *slog.Logger, ev PushEvent) DispatchResult {
+	token := os.Getenv("WOODPECKER_TOKEN")
+	if token == "" {
+		return DispatchResult{Err: fmt.Errorf("no WOODPECKER_TOKEN found")}
+	}
+	if d.Config.Host == "" || d.Config.Owner == "" || d.Config.Repo == "" {
+		return DispatchResult{Err: fmt.Errorf("woodpecker backend requires host, owner and repo")}
+	}
+
+	payload := struct {
+		Branch string `json:"branch"`
+	}{Branch: ev.Branch}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("marshal payload: %w", err)}
+	}
+	endpoint := fmt.Sprintf("https://%s/api/repos/%s/%s/pipelines", d.Config.Host, d.Config.Owner, d.Config.Repo)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("create request: %w", err)}
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("send request to woodpecker: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return DispatchResult{Err: fmt.Errorf("unexpected response from woodpecker %s: %s", res.Status, DefaultRedactor.Redact(string(body)))}
+	}
+	var response struct {
+		Number int    `json:"number"`
+		Status string `json:"status"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("read response: %w", err)}
+	}
+	lg.LogAttrs(ctx, slog.LevelDebug, "got response", slog.Int("number", response.Number), slog.String("status", response.Status))
+	return DispatchResult{
+		State:      response.Status,
+		ExternalID: strconv.Itoa(response.Number),
+		URL:        fmt.Sprintf("https://%s/repos/%s/%s/pipeline/%d", d.Config.Host, d.Config.Owner, d.Config.Repo, response.Number),
+	}
+}
+
+// DroneDispatcher triggers a new build via Drone's build API. The token comes
+// from DRONE_TOKEN.
+type DroneDispatcher struct {
+	Config *DroneConfig
+}
+
+func (d *DroneDispatcher) Name() string { return "drone" }
+
+func (d *DroneDispatcher) Dispatch(ctx context.Context, lg *slog.Logger, ev PushEvent) DispatchResult {
+	token := os.Getenv("DRONE_TOKEN")
+	if token == "" {
+		return DispatchResult{Err: fmt.Errorf("no DRONE_TOKEN found")}
+	}
+	if d.Config.Host == "" || d.Config.Owner == "" || d.Config.Repo == "" {
+		return DispatchResult{Err: fmt.Errorf("drone backend requires host, owner and repo")}
+	}
+
+	endpoint := fmt.Sprintf("https://%s/api/repos/%s/%s/builds?branch=%s", d.Config.Host, d.Config.Owner, d.Config.Repo, url.QueryEscape(ev.Branch))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("create request: %w", err)}
+	}
+	req.Header.Set("authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("send request to drone: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return DispatchResult{Err: fmt.Errorf("unexpected response from drone %s: %s", res.Status, DefaultRedactor.Redact(string(body)))}
+	}
+	var response struct {
+		Number int    `json:"number"`
+		Status string `json:"status"`
+		Link   string `json:"link"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return DispatchResult{Err: fmt.Errorf("read response: %w", err)}
+	}
+	lg.LogAttrs(ctx, slog.LevelDebug, "got response", slog.Int("number", response.Number), slog.String("status", response.Status))
+	return DispatchResult{State: response.Status, ExternalID: strconv.Itoa(response.Number), URL: response.Link}
+}
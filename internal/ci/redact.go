@@ -0,0 +1,84 @@
+package ci
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Redactor replaces known secret values with "***" in arbitrary text before
+// it reaches a log line or the push output a git client sees.
+type Redactor struct {
+	replacer *strings.Replacer
+	patterns []*regexp.Regexp
+}
+
+// secretEnvPattern matches environment variable names that hold credentials:
+// BUILDKITE_API_TOKEN, GITHUB_TOKEN, GITLAB_TRIGGER_TOKEN, WOODPECKER_TOKEN,
+// DRONE_TOKEN and anything a repo's own tooling sets that ends the same way.
+var secretEnvPattern = regexp.MustCompile(`(?:_TOKEN|_SECRET)$`)
+
+// commonSecretPatterns catches bearer tokens and well-known vendor token
+// formats even when the value didn't come from a *_TOKEN/*_SECRET env var
+// (e.g. one embedded in a URL or response body).
+var commonSecretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-_.=]+`),
+	regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{20,}`),
+	regexp.MustCompile(`glpat-[A-Za-z0-9\-_]{20,}`),
+}
+
+// NewRedactor builds a Redactor from the current environment's *_TOKEN and
+// *_SECRET values, plus a fixed set of vendor token patterns.
+func NewRedactor() *Redactor {
+	var pairs []string
+	for _, kv := range os.Environ() {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || value == "" || !secretEnvPattern.MatchString(name) {
+			continue
+		}
+		pairs = append(pairs, value, "***")
+	}
+	return &Redactor{
+		replacer: strings.NewReplacer(pairs...),
+		patterns: commonSecretPatterns,
+	}
+}
+
+// Redact returns s with every known secret value replaced by "***".
+func (r *Redactor) Redact(s string) string {
+	s = r.replacer.Replace(s)
+	for _, p := range r.patterns {
+		s = p.ReplaceAllString(s, "***")
+	}
+	return s
+}
+
+// DefaultRedactor is built from the process environment once at startup and
+// used by the dispatchers to scrub response bodies before they're ever
+// wrapped into a DispatchResult or logged.
+var DefaultRedactor = NewRedactor()
+
+// redactingWriter wraps w, redacting known secrets out of every Write before
+// it's passed through. It always reports having written len(p) bytes on
+// success, since the redacted rewrite it actually emits is rarely the same
+// length as p.
+type redactingWriter struct {
+	w io.Writer
+	r *Redactor
+}
+
+// NewRedactingWriter wraps w so nothing written through it can leak a secret
+// known to r. Intended for slog handlers and any writer that carries request
+// logging or response-body dumps from the CI dispatchers.
+func NewRedactingWriter(w io.Writer, r *Redactor) io.Writer {
+	return redactingWriter{w: w, r: r}
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	_, err := rw.w.Write([]byte(rw.r.Redact(string(p))))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,267 @@
+// Package jobqueue is a small embedded job store backing the githook
+// post-receive daemon: dispatches are enqueued here instead of being fired
+// inline, and a worker drains them with retry and backoff.
+package jobqueue
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Status is a Job's place in the new -> running -> {success, failure} state
+// machine. A job moves back from running to waiting (with a backed-off
+// NextRunAt) when a dispatch attempt fails and retries remain, and from
+// waiting to running again when it is next claimed.
+type Status string
+
+const (
+	StatusNew     Status = "new"
+	StatusWaiting Status = "waiting"
+	StatusRunning Status = "running"
+	StatusSuccess Status = "success"
+	StatusFailure Status = "failure"
+)
+
+// Job is one enqueued dispatch. Payload is an opaque blob the caller decodes
+// (e.g. a JSON-encoded backend config and push event); the store doesn't
+// interpret it.
+type Job struct {
+	UUID      string
+	Backend   string
+	Payload   []byte
+	Status    Status
+	Attempts  int
+	NextRunAt time.Time
+	Response  string
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// MaxAttempts bounds retries before a job is left in StatusFailure for good.
+const MaxAttempts = 8
+
+// Store is a SQLite-backed job queue, one file per bare repo.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens (creating if needed) the job store at path, typically
+// $GIT_DIR/githook.db. The post-receive hook and the daemon each open their
+// own *Store against the same file, so busy_timeout and WAL are set up
+// front to let SQLite queue a writer behind a brief lock instead of failing
+// the call outright with SQLITE_BUSY.
+func Open(path string) (*Store, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1) // modernc.org/sqlite is not safe for concurrent writers
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS jobs (
+			uuid        TEXT PRIMARY KEY,
+			backend     TEXT NOT NULL,
+			payload     BLOB NOT NULL,
+			status      TEXT NOT NULL,
+			attempts    INTEGER NOT NULL DEFAULT 0,
+			next_run_at INTEGER NOT NULL,
+			response    TEXT NOT NULL DEFAULT '',
+			error       TEXT NOT NULL DEFAULT '',
+			created_at  INTEGER NOT NULL,
+			updated_at  INTEGER NOT NULL
+		)`)
+	if err != nil {
+		return nil, fmt.Errorf("create jobs table: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// enqueueRetries bounds how many times Enqueue retries an insert that fails
+// with SQLITE_BUSY, on top of the busy_timeout Open already sets, since the
+// hook and the daemon each hit this file from a separate OS process.
+const enqueueRetries = 5
+
+// Enqueue inserts a new job in StatusNew, ready to be claimed immediately,
+// and returns its UUID.
+func (s *Store) Enqueue(ctx context.Context, backend string, payload []byte) (string, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return "", fmt.Errorf("generate uuid: %w", err)
+	}
+	now := timeNow()
+	for attempt := 0; ; attempt++ {
+		_, err = s.db.ExecContext(ctx, `
+			INSERT INTO jobs (uuid, backend, payload, status, attempts, next_run_at, created_at, updated_at)
+			VALUES (?, ?, ?, ?, 0, ?, ?, ?)`,
+			uuid, backend, payload, StatusNew, now.Unix(), now.Unix(), now.Unix())
+		if err == nil {
+			return uuid, nil
+		}
+		if !isBusy(err) || attempt == enqueueRetries {
+			return "", fmt.Errorf("insert job: %w", err)
+		}
+		time.Sleep(time.Duration(attempt+1) * 20 * time.Millisecond)
+	}
+}
+
+// isBusy reports whether err looks like SQLite's "another connection is
+// writing" error, the one busy_timeout is meant to absorb.
+func isBusy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "database is locked")
+}
+
+// ClaimNext atomically picks the ready job (status new or waiting,
+// next_run_at due) with the earliest next_run_at and marks it running, or
+// returns (nil, nil) if none are ready.
+func (s *Store) ClaimNext(ctx context.Context) (*Job, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := timeNow().Unix()
+	row := tx.QueryRowContext(ctx, `
+		SELECT uuid, backend, payload, status, attempts, next_run_at, response, error, created_at, updated_at
+		FROM jobs
+		WHERE status IN (?, ?) AND next_run_at <= ?
+		ORDER BY next_run_at ASC
+		LIMIT 1`, StatusNew, StatusWaiting, now)
+
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("scan job: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE jobs SET status = ?, updated_at = ? WHERE uuid = ?`, StatusRunning, timeNow().Unix(), job.UUID)
+	if err != nil {
+		return nil, fmt.Errorf("mark running: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit claim: %w", err)
+	}
+	job.Status = StatusRunning
+	return job, nil
+}
+
+// Complete records a successful dispatch.
+func (s *Store) Complete(ctx context.Context, uuid, response string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, response = ?, error = '', updated_at = ? WHERE uuid = ?`,
+		StatusSuccess, response, timeNow().Unix(), uuid)
+	if err != nil {
+		return fmt.Errorf("mark success: %w", err)
+	}
+	return nil
+}
+
+// Retry records a failed attempt. If attempts remain it reschedules the job
+// (waiting) to run backoff from now, using backoff exactly as the caller
+// computed it; otherwise it's a terminal failure.
+func (s *Store) Retry(ctx context.Context, uuid string, dispatchErr error, backoff time.Duration) error {
+	row := s.db.QueryRowContext(ctx, `SELECT attempts FROM jobs WHERE uuid = ?`, uuid)
+	var attempts int
+	if err := row.Scan(&attempts); err != nil {
+		return fmt.Errorf("read attempts: %w", err)
+	}
+	attempts++
+
+	status := StatusWaiting
+	nextRunAt := timeNow().Add(backoff)
+	if attempts >= MaxAttempts {
+		status = StatusFailure
+		nextRunAt = timeNow()
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, attempts = ?, next_run_at = ?, error = ?, updated_at = ? WHERE uuid = ?`,
+		status, attempts, nextRunAt.Unix(), dispatchErr.Error(), timeNow().Unix(), uuid)
+	if err != nil {
+		return fmt.Errorf("mark retry: %w", err)
+	}
+	return nil
+}
+
+// Get fetches a single job by UUID.
+func (s *Store) Get(ctx context.Context, uuid string) (*Job, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT uuid, backend, payload, status, attempts, next_run_at, response, error, created_at, updated_at
+		FROM jobs WHERE uuid = ?`, uuid)
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("job %s: %w", uuid, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("scan job: %w", err)
+	}
+	return job, nil
+}
+
+// List returns every job, most recently created first.
+func (s *Store) List(ctx context.Context) ([]*Job, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT uuid, backend, payload, status, attempts, next_run_at, response, error, created_at, updated_at
+		FROM jobs ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row scanner) (*Job, error) {
+	var job Job
+	var status string
+	var nextRunAt, createdAt, updatedAt int64
+	err := row.Scan(&job.UUID, &job.Backend, &job.Payload, &status, &job.Attempts,
+		&nextRunAt, &job.Response, &job.Error, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	job.Status = Status(status)
+	job.NextRunAt = time.Unix(nextRunAt, 0)
+	job.CreatedAt = time.Unix(createdAt, 0)
+	job.UpdatedAt = time.Unix(updatedAt, 0)
+	return &job, nil
+}
+
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// timeNow exists so tests can stub it; production always uses time.Now.
+var timeNow = time.Now
@@ -0,0 +1,148 @@
+package jobqueue
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, path
+}
+
+func TestStoreClaimRetryTerminalFailure(t *testing.T) {
+	store, _ := openTestStore(t)
+	ctx := context.Background()
+
+	now := time.Unix(1700000000, 0)
+	old := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = old })
+
+	uuid, err := store.Enqueue(ctx, "buildkite", []byte("payload"))
+	if err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	job, err := store.ClaimNext(ctx)
+	if err != nil {
+		t.Fatalf("ClaimNext() error = %v", err)
+	}
+	if job == nil || job.UUID != uuid {
+		t.Fatalf("ClaimNext() = %+v, want the enqueued job", job)
+	}
+	if job.Status != StatusRunning {
+		t.Fatalf("job.Status = %q, want %q", job.Status, StatusRunning)
+	}
+
+	// Fewer than MaxAttempts failures reschedule the job as waiting.
+	for i := 0; i < MaxAttempts-1; i++ {
+		if err := store.Retry(ctx, uuid, errors.New("dispatch boom"), 0); err != nil {
+			t.Fatalf("Retry() error = %v", err)
+		}
+		got, err := store.Get(ctx, uuid)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.Status != StatusWaiting {
+			t.Fatalf("after %d retries, status = %q, want %q", i+1, got.Status, StatusWaiting)
+		}
+	}
+
+	// The MaxAttempts'th failure is terminal.
+	if err := store.Retry(ctx, uuid, errors.New("dispatch boom"), 0); err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	got, err := store.Get(ctx, uuid)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Status != StatusFailure {
+		t.Fatalf("status after %d retries = %q, want %q", MaxAttempts, got.Status, StatusFailure)
+	}
+	if got.Attempts != MaxAttempts {
+		t.Fatalf("Attempts = %d, want %d", got.Attempts, MaxAttempts)
+	}
+	if got.Error != "dispatch boom" {
+		t.Fatalf("Error = %q, want %q", got.Error, "dispatch boom")
+	}
+}
+
+func TestStoreCompleteRecordsResponse(t *testing.T) {
+	store, _ := openTestStore(t)
+	ctx := context.Background()
+
+	uuid, err := store.Enqueue(ctx, "tekton", []byte("payload"))
+	if err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if _, err := store.ClaimNext(ctx); err != nil {
+		t.Fatalf("ClaimNext() error = %v", err)
+	}
+	if err := store.Complete(ctx, uuid, "triggered"); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+
+	got, err := store.Get(ctx, uuid)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Status != StatusSuccess || got.Response != "triggered" {
+		t.Fatalf("got = %+v, want status %q response %q", got, StatusSuccess, "triggered")
+	}
+}
+
+// TestStoreEnqueueConcurrentWriters reproduces two processes (the hook and
+// the daemon) hammering Enqueue against the same db file; Open's
+// busy_timeout/WAL setup and Enqueue's retry loop should absorb SQLITE_BUSY
+// rather than surface it to the caller.
+func TestStoreEnqueueConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.db")
+
+	a, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+	b, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	const n = 50
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, n*2)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := a.Enqueue(ctx, "buildkite", []byte("a")); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := b.Enqueue(ctx, "tekton", []byte("b")); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent Enqueue across two Store handles on the same db file: %v", err)
+	}
+}